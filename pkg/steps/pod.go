@@ -0,0 +1,497 @@
+package steps
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	coreclientset "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+
+	"github.com/openshift/ci-operator/pkg/api"
+)
+
+// artifactsContainerName is the name given to the sidecar responsible for
+// collecting and uploading the contents of ArtifactDir once the test
+// container finishes.
+const artifactsContainerName = "artifacts"
+
+// artifactsVolumeName is the emptyDir volume shared between the test
+// container and the artifacts sidecar, holding only the contents of
+// ArtifactDir. The completion marker lives on a separate volume (see
+// artifactsDoneVolumeName) so it never gets swept up into the uploaded
+// tarball.
+const artifactsVolumeName = "artifacts"
+
+// artifactsDoneVolumeName is a second emptyDir, distinct from
+// artifactsVolumeName, that holds only the completion marker.
+const artifactsDoneVolumeName = "artifacts-done"
+
+// artifactsDoneDir and artifactsDoneFile locate the completion marker the
+// test container writes once its Commands have finished executing. The
+// sidecar polls for this file, mirroring the Tekton entrypoint's
+// wait_file/post_file handshake.
+const artifactsDoneDir = "/tmp/artifacts-done"
+
+const artifactsDoneFile = artifactsDoneDir + "/exit-code"
+
+// PodStepConfiguration defines a step that executes a single test in a pod,
+// waits for it to terminate, and returns the status.
+type PodStepConfiguration struct {
+	As                 string
+	From               api.ImageStreamTagReference
+	Commands           string
+	ArtifactDir        string
+	ServiceAccountName string
+	SecretName         string
+	SecretMountPath    string
+	// SecretMounts projects individual keys out of one or more secrets into
+	// the test container, each at its own in-container path, rather than
+	// mounting an entire secret at a single location. This is useful when a
+	// test needs keys from several secrets (e.g. a kubeconfig from one and
+	// a token from another) at specific, unrelated paths.
+	SecretMounts []SecretMount
+
+	// ArtifactSidecarImage is the image used for the sidecar container that
+	// collects and uploads the contents of ArtifactDir. If empty, no
+	// sidecar is added even when ArtifactDir is set.
+	ArtifactSidecarImage string
+	// ArtifactUploadTarget is a GCS or S3 URL (e.g. "gs://bucket/path") that
+	// the sidecar uploads the collected artifacts to. If empty, the sidecar
+	// skips the upload step entirely: it still waits for the test container
+	// to finish, but leaves the contents of ArtifactDir on the pod's
+	// ephemeral storage rather than shipping them anywhere.
+	ArtifactUploadTarget string
+	// ArtifactPollInterval controls how frequently the sidecar checks for
+	// the completion marker written by the test container. Defaults to one
+	// second when unset.
+	ArtifactPollInterval time.Duration
+}
+
+// SecretMount projects one secret into the test container. When Items is
+// empty, the whole secret is mounted at MountPath, mirroring the behavior of
+// SecretName/SecretMountPath. When Items is non-empty, each entry is
+// projected individually via a subPath mount, so unrelated keys from the
+// same or different secrets can land at arbitrary, unrelated paths.
+type SecretMount struct {
+	SecretName string
+	Items      []SecretItem
+	MountPath  string
+}
+
+// SecretItem projects a single key from a SecretMount's secret to Path,
+// relative to the SecretMount's MountPath.
+type SecretItem struct {
+	Key  string
+	Path string
+}
+
+type podStep struct {
+	name        string
+	config      PodStepConfiguration
+	resources   api.ResourceConfiguration
+	podClient   PodClient
+	artifactDir string
+	jobSpec     *api.JobSpec
+
+	waiter     Waiter
+	runner     Runner
+	postWriter PostWriter
+	prowJobs   ProwJobGetter
+
+	// podUID is recorded once the pod has been created, and is used to
+	// detect a pod having been deleted and recreated under the same name
+	// while this step is still watching it.
+	podUID types.UID
+}
+
+// prowJobOwnerAPIVersion and prowJobOwnerKind identify the ProwJob CRD for
+// the OwnerReference podStep attaches to its pod, so the pod is garbage
+// collected when the ProwJob that requested it is deleted.
+const (
+	prowJobOwnerAPIVersion = "prow.k8s.io/v1"
+	prowJobOwnerKind       = "ProwJob"
+)
+
+// ProwJobGetter looks up the UID of the ProwJob identified by id within
+// namespace, so a step's pod can carry it as an OwnerReference. Implementations
+// typically wrap a client for the prow.k8s.io ProwJob CRD.
+type ProwJobGetter interface {
+	Get(ctx context.Context, namespace, id string) (types.UID, error)
+}
+
+// Waiter blocks until the pod started by a Runner reaches a terminal phase,
+// returning that phase (or an error if it could not be observed). It is
+// modeled on the half of the Tekton entrypointer that waits on another
+// step's completion file.
+// expectedUID, when non-empty, must match the UID of every pod observed
+// under name; a mismatch means the pod was deleted and recreated under the
+// same name while the step was watching it, which is treated as a failure
+// rather than silently waiting on the wrong pod.
+type Waiter interface {
+	Wait(ctx context.Context, namespace, name string, expectedUID types.UID) (v1.PodPhase, error)
+}
+
+// Runner creates the pod for a step (and, for implementations that stream
+// logs, begins doing so). It is modeled on the half of the Tekton
+// entrypointer that execs the real command.
+type Runner interface {
+	Run(ctx context.Context, namespace string, pod *v1.Pod) (*v1.Pod, error)
+}
+
+// PostWriter records the outcome of a step's pod once it has terminated,
+// e.g. uploading junit results or artifacts. runErr is the error (if any)
+// produced while running and waiting on the pod, and is passed through so a
+// PostWriter can tell a real failure apart from "nothing to record".
+type PostWriter interface {
+	Write(ctx context.Context, pod *v1.Pod, runErr error) error
+}
+
+// PodClient abstracts the subset of the Kubernetes client that podStep needs
+// so that callers unrelated to step execution (e.g. log retrieval tooling)
+// can share a single client construction path.
+type PodClient interface {
+	Pods(namespace string) coreclientset.PodInterface
+}
+
+type podClient struct {
+	core coreclientset.CoreV1Interface
+}
+
+func (c *podClient) Pods(namespace string) coreclientset.PodInterface {
+	return c.core.Pods(namespace)
+}
+
+// NewPodClient creates a PodClient from a core client. config and client are
+// reserved for future use by callers that need to stream logs or exec into
+// the pod out-of-band from Run(); they are not read here today.
+func NewPodClient(core coreclientset.CoreV1Interface, config *rest.Config, client interface{}) PodClient {
+	return &podClient{core: core}
+}
+
+func (s *podStep) Inputs(ctx context.Context, dry bool) (api.InputDefinition, error) {
+	return nil, nil
+}
+
+func (s *podStep) Run(ctx context.Context, dry bool) error {
+	if dry {
+		return nil
+	}
+
+	pod, err := s.getPodObject(ctx)
+	if err != nil {
+		return fmt.Errorf("could not generate pod for %s: %v", s.Name(), err)
+	}
+
+	pod, err = s.runner.Run(ctx, s.jobSpec.Namespace, pod)
+	if err != nil {
+		return fmt.Errorf("could not create pod for %s: %v", s.Name(), err)
+	}
+	s.podUID = pod.UID
+
+	var runErr error
+	if phase, waitErr := s.waiter.Wait(ctx, s.jobSpec.Namespace, s.Name(), s.podUID); waitErr != nil {
+		runErr = fmt.Errorf("could not wait for pod %s to complete: %v", s.Name(), waitErr)
+	} else if phase == v1.PodFailed {
+		runErr = fmt.Errorf("the pod %s failed after %s", s.Name(), phase)
+	}
+
+	if writeErr := s.postWriter.Write(ctx, pod, runErr); writeErr != nil && runErr == nil {
+		runErr = writeErr
+	}
+	return runErr
+}
+
+// kubeRunner is the default Runner: it creates the pod via the Kubernetes
+// API and returns the server's representation of it.
+type kubeRunner struct {
+	client PodClient
+}
+
+func (r *kubeRunner) Run(ctx context.Context, namespace string, pod *v1.Pod) (*v1.Pod, error) {
+	return r.client.Pods(namespace).Create(pod)
+}
+
+// kubeWaiter is the default Waiter: it watches the named pod until it
+// reaches a terminal phase, which for a pod with multiple containers only
+// happens once all of them have terminated.
+type kubeWaiter struct {
+	client PodClient
+}
+
+func (w *kubeWaiter) Wait(ctx context.Context, namespace, name string, expectedUID types.UID) (v1.PodPhase, error) {
+	watcher, err := w.client.Pods(namespace).Watch(meta.ListOptions{FieldSelector: fields.OneTermEqualSelector("metadata.name", name).String()})
+	if err != nil {
+		return "", fmt.Errorf("could not watch pod %s: %v", name, err)
+	}
+	defer watcher.Stop()
+
+	for event := range watcher.ResultChan() {
+		pod, ok := event.Object.(*v1.Pod)
+		if !ok {
+			continue
+		}
+		if expectedUID != "" && pod.UID != expectedUID {
+			return "", fmt.Errorf("pod %s has UID %s, expected %s: it was deleted and recreated while being watched", name, pod.UID, expectedUID)
+		}
+		switch pod.Status.Phase {
+		case v1.PodSucceeded, v1.PodFailed:
+			return pod.Status.Phase, nil
+		}
+	}
+	return "", fmt.Errorf("watch closed before pod %s completed", name)
+}
+
+// noopPostWriter is the default PostWriter. Junit/artifact upload for pod
+// steps is handled by the artifacts sidecar (see addArtifactsSidecar)
+// rather than by PostWriter today, so there is nothing to record here.
+type noopPostWriter struct{}
+
+func (noopPostWriter) Write(ctx context.Context, pod *v1.Pod, runErr error) error { return nil }
+
+func (s *podStep) getPodObject(ctx context.Context) (*v1.Pod, error) {
+	testCommand := fmt.Sprintf("#!/bin/sh\nset -eu\n%s", s.config.Commands)
+
+	container := v1.Container{
+		Name:                     s.name,
+		Image:                    fmt.Sprintf("%s:%s", s.config.From.Name, s.config.From.Tag),
+		Command:                  []string{"/bin/sh", "-c", testCommand},
+		TerminationMessagePolicy: v1.TerminationMessageFallbackToLogsOnError,
+	}
+
+	volumes := []v1.Volume{}
+	mounts := []v1.VolumeMount{}
+	mountPaths := map[string]string{}
+	if s.config.SecretName != "" {
+		mountPath := s.config.SecretMountPath
+		if mountPath == "" {
+			mountPath = defaultSecretMountPath(s.config.SecretName)
+		}
+		volumes = append(volumes, v1.Volume{
+			Name: s.config.SecretName,
+			VolumeSource: v1.VolumeSource{
+				Secret: &v1.SecretVolumeSource{SecretName: s.config.SecretName},
+			},
+		})
+		mounts = append(mounts, v1.VolumeMount{
+			Name:      s.config.SecretName,
+			MountPath: mountPath,
+			SubPath:   filepath.Base(mountPath),
+			ReadOnly:  true,
+		})
+		mountPaths[mountPath] = s.config.SecretName
+	}
+
+	for i, secretMount := range s.config.SecretMounts {
+		volumeName := fmt.Sprintf("secret-mount-%d", i)
+		volumes = append(volumes, v1.Volume{
+			Name: volumeName,
+			VolumeSource: v1.VolumeSource{
+				Secret: &v1.SecretVolumeSource{SecretName: secretMount.SecretName},
+			},
+		})
+
+		if len(secretMount.Items) == 0 {
+			mountPath := secretMount.MountPath
+			if existing, collides := mountPaths[mountPath]; collides {
+				return nil, fmt.Errorf("secret %s and %s both request mount path %s", existing, secretMount.SecretName, mountPath)
+			}
+			mountPaths[mountPath] = secretMount.SecretName
+			mounts = append(mounts, v1.VolumeMount{
+				Name:      volumeName,
+				MountPath: mountPath,
+				SubPath:   filepath.Base(mountPath),
+				ReadOnly:  true,
+			})
+			continue
+		}
+
+		for _, item := range secretMount.Items {
+			mountPath := filepath.Join(secretMount.MountPath, item.Path)
+			if existing, collides := mountPaths[mountPath]; collides {
+				return nil, fmt.Errorf("secret %s key %s and %s both request mount path %s", secretMount.SecretName, item.Key, existing, mountPath)
+			}
+			mountPaths[mountPath] = fmt.Sprintf("%s:%s", secretMount.SecretName, item.Key)
+			mounts = append(mounts, v1.VolumeMount{
+				Name:      volumeName,
+				MountPath: mountPath,
+				SubPath:   item.Key,
+				ReadOnly:  true,
+			})
+		}
+	}
+	container.VolumeMounts = mounts
+
+	pod := &v1.Pod{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      s.config.As,
+			Namespace: s.jobSpec.Namespace,
+			Labels: map[string]string{
+				"build-id":                s.jobSpec.BuildId,
+				"created-by-ci":           "true",
+				"job":                     s.jobSpec.Job,
+				"persists-between-builds": "false",
+				"prow.k8s.io/id":          s.jobSpec.ProwJobID,
+			},
+			Annotations: map[string]string{
+				"ci.openshift.io/job-spec":                     "",
+				"ci-operator.openshift.io/container-sub-tests": s.name,
+			},
+		},
+		Spec: v1.PodSpec{
+			Containers:    []v1.Container{container},
+			Volumes:       volumes,
+			RestartPolicy: v1.RestartPolicyNever,
+		},
+	}
+
+	if s.config.ArtifactDir != "" && s.config.ArtifactSidecarImage != "" {
+		addArtifactsSidecar(pod, &pod.Spec.Containers[0], s.config)
+	}
+
+	if s.prowJobs != nil {
+		uid, err := s.prowJobs.Get(ctx, s.jobSpec.Namespace, s.jobSpec.ProwJobID)
+		if err != nil {
+			return nil, fmt.Errorf("could not look up ProwJob %s to set as pod owner: %v", s.jobSpec.ProwJobID, err)
+		}
+		pod.OwnerReferences = append(pod.OwnerReferences, meta.OwnerReference{
+			APIVersion: prowJobOwnerAPIVersion,
+			Kind:       prowJobOwnerKind,
+			Name:       s.jobSpec.ProwJobID,
+			UID:        uid,
+		})
+	}
+
+	return pod, nil
+}
+
+// addArtifactsSidecar wires two emptyDir volumes shared between
+// testContainer and a new sidecar container into pod: one holding the
+// contents of ArtifactDir, the other holding only the completion marker, so
+// the marker never ends up inside the tarball the sidecar uploads. It wraps
+// testContainer's command so it writes the marker once it exits -
+// regardless of whether the user's Commands succeeded or failed - and
+// appends the sidecar that polls for that marker before tarring up and
+// uploading the artifacts directory. When ArtifactUploadTarget is empty the
+// sidecar only logs that nothing is uploaded; it neither tars nor uploads.
+func addArtifactsSidecar(pod *v1.Pod, testContainer *v1.Container, config PodStepConfiguration) {
+	pollInterval := config.ArtifactPollInterval
+	if pollInterval == 0 {
+		pollInterval = time.Second
+	}
+
+	pod.Spec.Volumes = append(pod.Spec.Volumes,
+		v1.Volume{Name: artifactsVolumeName, VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}},
+		v1.Volume{Name: artifactsDoneVolumeName, VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}},
+	)
+
+	artifactsMount := v1.VolumeMount{Name: artifactsVolumeName, MountPath: config.ArtifactDir}
+	doneMount := v1.VolumeMount{Name: artifactsDoneVolumeName, MountPath: artifactsDoneDir}
+	testContainer.VolumeMounts = append(testContainer.VolumeMounts, artifactsMount, doneMount)
+
+	// The user's Commands run inside a subshell with its own "set -eu" so a
+	// failure there only exits the subshell, not the whole script: the
+	// marker-writing lines below always run and report the real exit code.
+	testContainer.Command = []string{"/bin/sh", "-c", fmt.Sprintf(
+		"#!/bin/sh\n(set -eu\n%s\n)\nexit_code=$?\nmkdir -p %s\necho \"${exit_code}\" > %s\nexit \"${exit_code}\"",
+		config.Commands, artifactsDoneDir, artifactsDoneFile,
+	)}
+
+	uploadCommand := fmt.Sprintf("echo \"no ArtifactUploadTarget configured, leaving artifacts in %s\"", config.ArtifactDir)
+	if config.ArtifactUploadTarget != "" {
+		uploadCommand = fmt.Sprintf(
+			"tar -C %s -czf /tmp/artifacts.tar.gz .\nupload-artifacts --target=%q /tmp/artifacts.tar.gz",
+			config.ArtifactDir, config.ArtifactUploadTarget,
+		)
+	}
+
+	sidecar := v1.Container{
+		Name:  artifactsContainerName,
+		Image: config.ArtifactSidecarImage,
+		Command: []string{"/bin/sh", "-c", fmt.Sprintf(
+			"until [ -f %s ]; do sleep %s; done\n%s",
+			artifactsDoneFile, pollInterval, uploadCommand,
+		)},
+		VolumeMounts: []v1.VolumeMount{artifactsMount, doneMount},
+	}
+
+	pod.Spec.Containers = append(pod.Spec.Containers, sidecar)
+}
+
+func defaultSecretMountPath(secretName string) string {
+	return fmt.Sprintf("/tmp/secrets/%s", secretName)
+}
+
+func (s *podStep) Requires() []api.StepLink {
+	return []api.StepLink{api.ImagesReadyLink()}
+}
+
+func (s *podStep) Creates() []api.StepLink {
+	return []api.StepLink{}
+}
+
+func (s *podStep) Provides() (api.ParameterMap, api.StepLink) {
+	return nil, nil
+}
+
+func (s *podStep) Name() string { return s.config.As }
+
+func (s *podStep) Description() string {
+	return fmt.Sprintf("Run test command %q in a pod", s.config.Commands)
+}
+
+// PodStepOption customizes a podStep's execution machinery. Most callers do
+// not need these; they exist so tests (and non-pod backends such as a local
+// exec runner for ci-operator dry-runs) can substitute fakes for the
+// Kubernetes-client-backed Waiter, Runner and PostWriter without having to
+// drive a full fake.NewSimpleClientset and watcher goroutine.
+type PodStepOption func(*podStep)
+
+// WithWaiter overrides the default Kubernetes-watch-based Waiter.
+func WithWaiter(w Waiter) PodStepOption {
+	return func(s *podStep) { s.waiter = w }
+}
+
+// WithRunner overrides the default Kubernetes-create-based Runner.
+func WithRunner(r Runner) PodStepOption {
+	return func(s *podStep) { s.runner = r }
+}
+
+// WithPostWriter overrides the default no-op PostWriter.
+func WithPostWriter(p PostWriter) PodStepOption {
+	return func(s *podStep) { s.postWriter = p }
+}
+
+// WithProwJobGetter enables owner-reference wiring: the pod podStep creates
+// will be owned by the ProwJob g resolves for the step's ProwJobID, so it is
+// garbage collected when that ProwJob is deleted. Without this option no
+// owner reference is set, matching today's behavior.
+func WithProwJobGetter(g ProwJobGetter) PodStepOption {
+	return func(s *podStep) { s.prowJobs = g }
+}
+
+// PodStep returns a step that runs a single test command in a pod and waits
+// for its completion. By default it waits on and creates the pod through
+// podClient; pass options to substitute other implementations.
+func PodStep(name string, config PodStepConfiguration, resources api.ResourceConfiguration, podClient PodClient, artifactDir string, jobSpec *api.JobSpec, opts ...PodStepOption) api.Step {
+	s := &podStep{
+		name:        name,
+		config:      config,
+		resources:   resources,
+		podClient:   podClient,
+		artifactDir: artifactDir,
+		jobSpec:     jobSpec,
+		waiter:      &kubeWaiter{client: podClient},
+		runner:      &kubeRunner{client: podClient},
+		postWriter:  noopPostWriter{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
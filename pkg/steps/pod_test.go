@@ -1,14 +1,23 @@
 package steps
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/equality"
 	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/diff"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes/fake"
+	coreclientset "k8s.io/client-go/kubernetes/typed/core/v1"
 
 	"github.com/openshift/ci-operator/pkg/api"
 )
@@ -184,6 +193,189 @@ func TestPodStepExecution(t *testing.T) {
 	}
 }
 
+// fakeRunner and fakeWaiter let tests exercise podStep.Run without standing
+// up a fake.NewSimpleClientset and a watcher goroutine to play the part of
+// the cluster, mirroring the Waiter/Runner split podStep is built on.
+type fakeRunner struct {
+	pod *v1.Pod
+	err error
+}
+
+func (r *fakeRunner) Run(ctx context.Context, namespace string, pod *v1.Pod) (*v1.Pod, error) {
+	r.pod = pod
+	return pod, r.err
+}
+
+type fakeWaiter struct {
+	phase v1.PodPhase
+	err   error
+}
+
+func (w *fakeWaiter) Wait(ctx context.Context, namespace, name string, expectedUID types.UID) (v1.PodPhase, error) {
+	return w.phase, w.err
+}
+
+func TestPodStepExecutionWithFakes(t *testing.T) {
+	namespace := "TestNamespace"
+	testCases := []struct {
+		purpose        string
+		podStatus      v1.PodPhase
+		expectRunError bool
+	}{
+		{
+			purpose:        "Pod run by PodStep succeeds so PodStep terminates and returns no error",
+			podStatus:      v1.PodSucceeded,
+			expectRunError: false,
+		}, {
+			purpose:        "Pod run by PodStep fails so PodStep terminates and returns an error",
+			podStatus:      v1.PodFailed,
+			expectRunError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.purpose, func(t *testing.T) {
+			ps, _, _ := preparePodStep(t, namespace)
+			runner := &fakeRunner{}
+			waiter := &fakeWaiter{phase: tc.podStatus}
+
+			step := PodStep(ps.name, ps.config, ps.resources, ps.podClient, ps.artifactDir, ps.jobSpec, WithRunner(runner), WithWaiter(waiter))
+
+			err := step.Run(context.Background(), false)
+			if tc.expectRunError && err == nil {
+				t.Errorf("expected an error from Run(), got none")
+			}
+			if !tc.expectRunError && err != nil {
+				t.Errorf("expected no error from Run(), got: %v", err)
+			}
+			if runner.pod == nil {
+				t.Errorf("expected the fake runner to have been given a pod to create")
+			}
+		})
+	}
+}
+
+func TestGetPodObjectArtifactsSidecar(t *testing.T) {
+	ps := expectedPodStepTemplate()
+	ps.config.ArtifactDir = "/tmp/artifacts"
+	ps.config.ArtifactSidecarImage = "artifacts-uploader:latest"
+	ps.config.ArtifactUploadTarget = "gs://test-bucket/artifacts"
+
+	pod, err := ps.getPodObject(context.Background())
+	if err != nil {
+		t.Fatalf("getPodObject() returned an error: %v", err)
+	}
+
+	if len(pod.Spec.Containers) != 2 {
+		t.Fatalf("expected a test container and an artifacts sidecar, got %d containers", len(pod.Spec.Containers))
+	}
+
+	sidecar := pod.Spec.Containers[1]
+	if sidecar.Name != artifactsContainerName {
+		t.Errorf("expected sidecar container named %q, got %q", artifactsContainerName, sidecar.Name)
+	}
+	if sidecar.Image != ps.config.ArtifactSidecarImage {
+		t.Errorf("expected sidecar image %q, got %q", ps.config.ArtifactSidecarImage, sidecar.Image)
+	}
+
+	foundSharedVolume := false
+	for _, v := range pod.Spec.Volumes {
+		if v.Name == artifactsVolumeName {
+			foundSharedVolume = true
+			if v.VolumeSource.EmptyDir == nil {
+				t.Errorf("expected %s volume to be an emptyDir, got %+v", artifactsVolumeName, v.VolumeSource)
+			}
+		}
+	}
+	if !foundSharedVolume {
+		t.Errorf("expected a shared %s emptyDir volume, got %v", artifactsVolumeName, pod.Spec.Volumes)
+	}
+
+	testContainer := pod.Spec.Containers[0]
+	wrappedCommand := testContainer.Command[len(testContainer.Command)-1]
+	if !strings.Contains(wrappedCommand, artifactsDoneFile) {
+		t.Errorf("expected test container command to write the completion marker %s, got %q", artifactsDoneFile, wrappedCommand)
+	}
+	if !strings.Contains(wrappedCommand, ps.config.Commands) {
+		t.Errorf("expected test container command to still run the original commands %q, got %q", ps.config.Commands, wrappedCommand)
+	}
+
+	if !containsVolumeMount(testContainer.VolumeMounts, artifactsVolumeName) {
+		t.Errorf("expected test container to mount the shared %s volume, got %v", artifactsVolumeName, testContainer.VolumeMounts)
+	}
+	if !containsVolumeMount(sidecar.VolumeMounts, artifactsVolumeName) {
+		t.Errorf("expected sidecar to mount the shared %s volume, got %v", artifactsVolumeName, sidecar.VolumeMounts)
+	}
+	if !containsVolumeMount(sidecar.VolumeMounts, artifactsDoneVolumeName) || !containsVolumeMount(testContainer.VolumeMounts, artifactsDoneVolumeName) {
+		t.Errorf("expected the test container and sidecar to share the %s volume", artifactsDoneVolumeName)
+	}
+}
+
+// TestArtifactsSidecarMarkerSurvivesFailure actually runs the test
+// container's generated command through /bin/sh to verify the completion
+// marker is written - with the real, non-zero exit code - even when
+// Commands fails. A failing Commands run under a bare "set -eu" for the
+// whole script would abort before ever reaching the marker-writing lines,
+// which would hang the sidecar's "until [ -f marker ]" loop forever; a
+// purely static string-contains check on the command can't catch that.
+func TestArtifactsSidecarMarkerSurvivesFailure(t *testing.T) {
+	testCases := []struct {
+		name         string
+		commands     string
+		wantExitCode string
+	}{
+		{name: "succeeding commands still write the marker", commands: "true", wantExitCode: "0"},
+		{name: "failing commands still write the marker", commands: "false", wantExitCode: "1"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			doneDir, err := ioutil.TempDir("", "artifacts-done")
+			if err != nil {
+				t.Fatalf("could not create temp dir: %v", err)
+			}
+			defer os.RemoveAll(doneDir)
+			doneFile := filepath.Join(doneDir, "exit-code")
+
+			ps := expectedPodStepTemplate()
+			ps.config.Commands = tc.commands
+			ps.config.ArtifactDir = "/tmp/artifacts"
+			ps.config.ArtifactSidecarImage = "artifacts-uploader:latest"
+
+			pod, err := ps.getPodObject(context.Background())
+			if err != nil {
+				t.Fatalf("getPodObject() returned an error: %v", err)
+			}
+
+			wrappedCommand := pod.Spec.Containers[0].Command[len(pod.Spec.Containers[0].Command)-1]
+			wrappedCommand = strings.NewReplacer(artifactsDoneDir, doneDir, artifactsDoneFile, doneFile).Replace(wrappedCommand)
+
+			if err := exec.Command("/bin/sh", "-c", wrappedCommand).Run(); err == nil && tc.wantExitCode != "0" {
+				t.Fatalf("expected the wrapped command itself to exit non-zero for %q", tc.commands)
+			} else if err != nil && tc.wantExitCode == "0" {
+				t.Fatalf("expected the wrapped command to exit zero for %q, got: %v", tc.commands, err)
+			}
+
+			got, err := ioutil.ReadFile(doneFile)
+			if err != nil {
+				t.Fatalf("completion marker was never written: %v", err)
+			}
+			if strings.TrimSpace(string(got)) != tc.wantExitCode {
+				t.Errorf("expected marker to contain exit code %q, got %q", tc.wantExitCode, string(got))
+			}
+		})
+	}
+}
+
+func containsVolumeMount(mounts []v1.VolumeMount, name string) bool {
+	for _, m := range mounts {
+		if m.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 func TestGetPodObjectMounts(t *testing.T) {
 	testCases := []struct {
 		name                 string
@@ -278,7 +470,7 @@ func TestGetPodObjectMounts(t *testing.T) {
 			podStepTemplate := expectedPodStepTemplate()
 			tc.podStep(podStepTemplate)
 
-			pod, err := podStepTemplate.getPodObject()
+			pod, err := podStepTemplate.getPodObject(context.Background())
 			if err != nil {
 				t.Errorf("test case %s error %v", tc.name, err)
 			}
@@ -297,6 +489,216 @@ func TestGetPodObjectMounts(t *testing.T) {
 
 }
 
+func TestGetPodObjectSecretMounts(t *testing.T) {
+	testCases := []struct {
+		name        string
+		secretMount []SecretMount
+		expectError bool
+	}{
+		{
+			name: "whole secret mounted when no items given",
+			secretMount: []SecretMount{
+				{SecretName: testSecretName, MountPath: testSecretDefaultPath},
+			},
+		},
+		{
+			name: "individual keys from multiple secrets projected to distinct paths",
+			secretMount: []SecretMount{
+				{
+					SecretName: "kubeconfig-secret",
+					MountPath:  "/root/.kube",
+					Items:      []SecretItem{{Key: "kubeconfig", Path: "config"}},
+				},
+				{
+					SecretName: "token-secret",
+					MountPath:  "/var/run/secrets",
+					Items:      []SecretItem{{Key: "token", Path: "token"}},
+				},
+			},
+		},
+		{
+			name: "colliding mount paths across secrets are rejected",
+			secretMount: []SecretMount{
+				{
+					SecretName: "first-secret",
+					MountPath:  "/var/run/secrets",
+					Items:      []SecretItem{{Key: "a", Path: "shared"}},
+				},
+				{
+					SecretName: "second-secret",
+					MountPath:  "/var/run/secrets",
+					Items:      []SecretItem{{Key: "b", Path: "shared"}},
+				},
+			},
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ps := expectedPodStepTemplate()
+			ps.config.SecretMounts = tc.secretMount
+
+			pod, err := ps.getPodObject(context.Background())
+			if tc.expectError {
+				if err == nil {
+					t.Fatalf("expected a collision error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getPodObject() returned an error: %v", err)
+			}
+
+			if len(pod.Spec.Volumes) != len(tc.secretMount) {
+				t.Errorf("expected %d volumes (one per secret), got %d", len(tc.secretMount), len(pod.Spec.Volumes))
+			}
+
+			wantMounts := 0
+			for _, sm := range tc.secretMount {
+				if len(sm.Items) == 0 {
+					wantMounts++
+					continue
+				}
+				wantMounts += len(sm.Items)
+			}
+			if got := len(pod.Spec.Containers[0].VolumeMounts); got != wantMounts {
+				t.Errorf("expected %d volume mounts, got %d", wantMounts, got)
+			}
+
+			for _, sm := range tc.secretMount {
+				for _, item := range sm.Items {
+					wantPath := filepath.Join(sm.MountPath, item.Path)
+					found := false
+					for _, m := range pod.Spec.Containers[0].VolumeMounts {
+						if m.MountPath == wantPath && m.SubPath == item.Key {
+							found = true
+						}
+					}
+					if !found {
+						t.Errorf("expected a mount for %s:%s at %s, got %v", sm.SecretName, item.Key, wantPath, pod.Spec.Containers[0].VolumeMounts)
+					}
+				}
+			}
+		})
+	}
+}
+
+type fakeProwJobGetter struct {
+	uid types.UID
+	err error
+}
+
+func (g *fakeProwJobGetter) Get(ctx context.Context, namespace, id string) (types.UID, error) {
+	return g.uid, g.err
+}
+
+func TestGetPodObjectOwnerReference(t *testing.T) {
+	ps := expectedPodStepTemplate()
+
+	pod, err := ps.getPodObject(context.Background())
+	if err != nil {
+		t.Fatalf("getPodObject() returned an error: %v", err)
+	}
+	if len(pod.OwnerReferences) != 0 {
+		t.Errorf("expected no owner references without a ProwJobGetter, got %v", pod.OwnerReferences)
+	}
+
+	ps.prowJobs = &fakeProwJobGetter{uid: types.UID("prow-job-uid")}
+	pod, err = ps.getPodObject(context.Background())
+	if err != nil {
+		t.Fatalf("getPodObject() returned an error: %v", err)
+	}
+
+	if len(pod.OwnerReferences) != 1 {
+		t.Fatalf("expected exactly one owner reference, got %v", pod.OwnerReferences)
+	}
+	owner := pod.OwnerReferences[0]
+	if owner.Kind != prowJobOwnerKind || owner.Name != ps.jobSpec.ProwJobID || owner.UID != types.UID("prow-job-uid") {
+		t.Errorf("unexpected owner reference: %+v", owner)
+	}
+}
+
+// singleWatchPodClient hands out one pre-established watch.Interface instead
+// of creating a new one on every Watch() call, so a test can register the
+// watch itself - deterministically, before any pod mutation happens - and
+// be sure kubeWaiter observes every event from that point on. This sidesteps
+// the fake clientset's behavior of never replaying events to a watch
+// registered after an object already changed.
+type singleWatchPodClient struct {
+	coreclientset.PodInterface
+	watcher watch.Interface
+}
+
+func (c *singleWatchPodClient) Watch(meta.ListOptions) (watch.Interface, error) {
+	return c.watcher, nil
+}
+
+type singleWatchClient struct {
+	underlying PodClient
+	watcher    watch.Interface
+}
+
+func (c *singleWatchClient) Pods(namespace string) coreclientset.PodInterface {
+	return &singleWatchPodClient{PodInterface: c.underlying.Pods(namespace), watcher: c.watcher}
+}
+
+func TestKubeWaiterDetectsRecreatedPod(t *testing.T) {
+	namespace := "TestNamespace"
+	podName := "TestName"
+	fakecs := ciopTestingClient{
+		kubecs:  fake.NewSimpleClientset(),
+		imagecs: nil,
+		t:       t,
+	}
+	real := NewPodClient(fakecs.Core(), nil, nil)
+
+	// Register the watch before the pod exists at all.
+	watcher, err := real.Pods(namespace).Watch(meta.ListOptions{})
+	if err != nil {
+		t.Fatalf("failed to create a watcher over pods in namespace")
+	}
+	defer watcher.Stop()
+
+	waiter := &kubeWaiter{client: &singleWatchClient{underlying: real, watcher: watcher}}
+	resultCh := make(chan error, 1)
+	go func() {
+		_, waitErr := waiter.Wait(context.Background(), namespace, podName, types.UID("original-uid"))
+		resultCh <- waitErr
+	}()
+
+	pod := &v1.Pod{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      podName,
+			Namespace: namespace,
+			UID:       types.UID("original-uid"),
+		},
+	}
+	if _, err := real.Pods(namespace).Create(pod); err != nil {
+		t.Fatalf("could not create test pod: %v", err)
+	}
+
+	// Simulate the pod being deleted and recreated under the same name
+	// with a different UID while the step is still watching it.
+	if err := real.Pods(namespace).Delete(podName, &meta.DeleteOptions{}); err != nil {
+		t.Fatalf("could not delete test pod: %v", err)
+	}
+	recreated := pod.DeepCopy()
+	recreated.UID = types.UID("recreated-uid")
+	if _, err := real.Pods(namespace).Create(recreated); err != nil {
+		t.Fatalf("could not recreate test pod: %v", err)
+	}
+
+	select {
+	case err := <-resultCh:
+		if err == nil {
+			t.Errorf("expected Wait() to detect the UID mismatch and return an error, got none")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Wait() to detect the recreated pod")
+	}
+}
+
 func expectedPodStepTemplate() *podStep {
 	return &podStep{
 		jobSpec: &api.JobSpec{